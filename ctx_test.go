@@ -0,0 +1,71 @@
+// Copyright (C) 2018 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sophie
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startHungSavdid starts a local TCP stub that accepts a connection,
+// reads whatever the client sends and then never replies, simulating a
+// server that has wedged mid-scan.
+func startHungSavdid(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 256)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// TestScanReaderContextCancellation guards against cancelling a
+// deadline-less ctx (the common context.WithCancel case) doing nothing
+// until cmdTimeout elapses on its own.
+func TestScanReaderContextCancellation(t *testing.T) {
+	addr := startHungSavdid(t)
+	c, err := NewClient("tcp", addr)
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+	c.SetCmdTimeout(10 * time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err = c.ScanReaderContext(ctx, strings.NewReader("hello sophie"))
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("An error should be returned")
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("ScanReaderContext took %s to return after cancellation, want well under the %s cmdTimeout", elapsed, c.cmdTimeout)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2018 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sophie
+
+import (
+	"errors"
+	"net"
+)
+
+// Sentinel errors returned by Client operations. Use errors.Is to test
+// for a specific cause and errors.As to recover the wrapping *SophieError
+// or an underlying *net.OpError.
+var (
+	// ErrUnsupportedProto is returned when NewClient is given a network
+	// other than tcp, tcp4, tcp6, unix or unixpacket
+	ErrUnsupportedProto = errors.New("protocol is not supported")
+	// ErrUnknownStatus is returned when the server replies with the -1
+	// status; any other unrecognised reply yields ErrInvalidResponse
+	ErrUnknownStatus = errors.New("unknown status")
+	// ErrInvalidResponse is returned when the server reply cannot be parsed
+	ErrInvalidResponse = errors.New("invalid server response")
+	// ErrTCPDir is returned when Scan is given a directory over a TCP
+	// connection
+	ErrTCPDir = errors.New("scanning directories not supported on a tcp connection")
+	// ErrUnixSockMissing is returned when NewClient is given a unix
+	// socket path that does not exist
+	ErrUnixSockMissing = errors.New("unix socket does not exist")
+)
+
+// SophieError records an error together with the operation, network,
+// address and path that caused it, analogous to net.OpError.
+type SophieError struct {
+	// Op is the operation that caused the error, e.g. "dial", "scan"
+	// or "stream"
+	Op string
+	// Net is the network type, e.g. "tcp" or "unix"
+	Net string
+	// Addr is the network address the operation was performed against,
+	// if any
+	Addr net.Addr
+	// Path is the filesystem path the operation was performed against,
+	// if any
+	Path string
+	// Err is the underlying error
+	Err error
+}
+
+// Error implements the error interface
+func (e *SophieError) Error() string {
+	if e == nil {
+		return "<nil>"
+	}
+	s := e.Op
+	if e.Net != "" {
+		s += " " + e.Net
+	}
+	if e.Addr != nil {
+		s += " " + e.Addr.String()
+	}
+	if e.Path != "" {
+		s += " " + e.Path
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Unwrap returns the underlying error so that errors.Is and errors.As
+// can see through a *SophieError
+func (e *SophieError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,49 @@
+// Copyright (C) 2018 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sophie
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// TestSophieErrorAddr verifies that a *SophieError raised after a
+// connection is established carries the remote address it came from.
+func TestSophieErrorAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("nope\r\n"))
+	}()
+
+	c, err := NewClient("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+
+	_, err = c.ScanReader(strings.NewReader("hello"))
+	if err == nil {
+		t.Fatal("An error should be returned")
+	}
+	var se *SophieError
+	if !errors.As(err, &se) {
+		t.Fatalf("Got %q want a *SophieError", err)
+	}
+	if se.Addr == nil || se.Addr.String() != ln.Addr().String() {
+		t.Errorf("SophieError.Addr = %v, want %s", se.Addr, ln.Addr())
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright (C) 2018 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sophie
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of a single scan performed as part of a batch
+// operation such as ScanAll or ScanReaders
+type Result struct {
+	Response *Response
+	Err      error
+}
+
+// pooledConn pairs a textproto.Conn with the underlying net.Conn it
+// wraps, since textproto.Conn does not expose it and callers need it
+// to set read/write deadlines
+type pooledConn struct {
+	conn net.Conn
+	tc   *textproto.Conn
+}
+
+func (pc *pooledConn) close() {
+	pc.tc.Close()
+}
+
+// SetMaxConns sets the maximum number of connections kept in the pool
+// and hence the concurrency used by ScanAll and ScanReaders. Existing
+// pooled connections are closed and the pool is reset. It is safe to
+// call concurrently with in-flight scans; connections returned against
+// the old pool by a scan started before the resize are simply closed.
+func (c *Client) SetMaxConns(n int) {
+	if n < 1 {
+		n = 1
+	}
+	c.poolMu.Lock()
+	defer c.poolMu.Unlock()
+	old := c.pool
+	c.maxConns = n
+	c.pool = make(chan *pooledConn, n)
+	close(old)
+	for pc := range old {
+		pc.close()
+	}
+}
+
+// getConn returns a pooled connection, reusing one if available or
+// dialing a new one otherwise. A receive from a pool channel closed out
+// from under it by a concurrent SetMaxConns yields ok == false rather
+// than blocking, in which case it falls through to dialing fresh.
+func (c *Client) getConn(ctx context.Context) (*pooledConn, error) {
+	c.poolMu.Lock()
+	pool := c.pool
+	c.poolMu.Unlock()
+
+	select {
+	case pc, ok := <-pool:
+		if ok {
+			return pc, nil
+		}
+	default:
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{conn: conn, tc: textproto.NewConn(conn)}, nil
+}
+
+// putConn returns a healthy connection to the pool, or closes it if it
+// is unhealthy or the pool is full. The connection goes to the pool
+// current when putConn is called. If a concurrent SetMaxConns closes
+// that pool before the send, the send panics; that is recovered and
+// the connection is closed instead of being resurrected into the old,
+// discarded pool.
+func (c *Client) putConn(pc *pooledConn, healthy bool) {
+	if !healthy {
+		pc.close()
+		return
+	}
+
+	c.poolMu.Lock()
+	pool := c.pool
+	c.poolMu.Unlock()
+
+	defer func() {
+		if recover() != nil {
+			pc.close()
+		}
+	}()
+
+	select {
+	case pool <- pc:
+	default:
+		pc.close()
+	}
+}
+
+// isNetErr reports whether err is a network error, meaning the
+// connection that produced it should not be returned to the pool
+func isNetErr(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// withPooledConn runs fn against a pooled connection, retrying on
+// another connection (an idle pooled one if available, otherwise a
+// freshly dialed one; using connRetries/connSleep) when the connection
+// turns out to be broken. reset, if non-nil, is called
+// before each retry to rewind any reader fn already partially consumed
+// on the failed attempt; it may be nil when fn carries no such state
+// (e.g. a path-based scan). Callers whose fn sends from a reader must
+// supply a reset that restores it, or the retry will redeclare the
+// original length while only the unsent remainder gets written.
+func (c *Client) withPooledConn(ctx context.Context, reset func() error, fn func(conn net.Conn, tc *textproto.Conn) (*Response, error)) (r *Response, err error) {
+	for attempt := 0; attempt <= c.connRetries; attempt++ {
+		var pc *pooledConn
+		if pc, err = c.getConn(ctx); err != nil {
+			return nil, err
+		}
+
+		r, err = fn(pc.conn, pc.tc)
+		if err == nil || !isNetErr(err) {
+			c.putConn(pc, err == nil)
+			return r, err
+		}
+
+		pc.close()
+		if attempt < c.connRetries {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(c.connSleep):
+			}
+			if reset != nil {
+				if err = reset(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return r, err
+}
+
+// ScanAll scans multiple files or directories concurrently, using up to
+// MaxConns pooled connections. Results are returned in the same order
+// as paths.
+func (c *Client) ScanAll(ctx context.Context, paths []string) []Result {
+	return c.batch(ctx, len(paths), func(i int) (*Response, error) {
+		return c.scanPooled(ctx, paths[i])
+	})
+}
+
+// ScanReaders scans multiple io.Readers concurrently, using up to
+// MaxConns pooled connections. Results are returned in the same order
+// as readers.
+func (c *Client) ScanReaders(ctx context.Context, readers []io.Reader) []Result {
+	return c.batch(ctx, len(readers), func(i int) (*Response, error) {
+		return c.streamPooled(ctx, readers[i])
+	})
+}
+
+func (c *Client) scanPooled(ctx context.Context, p string) (r *Response, err error) {
+	stat, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.network != "unix" && c.network != "unixpacket" {
+		if stat.IsDir() {
+			return nil, &SophieError{Op: "scan", Net: c.network, Path: p, Err: ErrTCPDir}
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return c.streamPooled(ctx, f)
+	}
+
+	return c.withPooledConn(ctx, nil, func(conn net.Conn, tc *textproto.Conn) (*Response, error) {
+		return c.scanPath(ctx, conn, tc, p)
+	})
+}
+
+func (c *Client) streamPooled(ctx context.Context, i io.Reader) (r *Response, err error) {
+	i, reset, cleanup, err := c.resettableReader(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	return c.withPooledConn(ctx, reset, func(conn net.Conn, tc *textproto.Conn) (*Response, error) {
+		return c.streamPath(ctx, conn, tc, i)
+	})
+}
+
+// resettableReader returns a reader over the same content as i that
+// withPooledConn can safely replay across retries, along with a reset
+// func rewinding it to its start and a cleanup func releasing any
+// resources resettableReader allocated.
+//
+// i is returned as-is, with reset seeking it back to its current
+// offset, when it is an io.Seeker (*os.File, *bytes.Reader and
+// *strings.Reader, the types streamPath already knows how to size, all
+// qualify). Anything else — notably *bytes.Buffer, whose Len() reports
+// only the unread remainder and which cannot be rewound at all — is
+// spooled once up front via sizeReader, so every attempt reads from an
+// independent copy instead of resending the tail of whatever the
+// previous, failed attempt left unread.
+func (c *Client) resettableReader(ctx context.Context, i io.Reader) (src io.Reader, reset func() error, cleanup func(), err error) {
+	if sk, ok := i.(io.Seeker); ok {
+		start, err := sk.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return i, func() error {
+			_, err := sk.Seek(start, io.SeekStart)
+			return err
+		}, func() {}, nil
+	}
+
+	spooled, _, cleanup, err := c.sizeReader(ctx, i)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	// sizeReader always returns a *bytes.Reader or *os.File, both
+	// io.Seeker, so this recurses exactly once into the branch above.
+	if src, reset, _, err = c.resettableReader(ctx, spooled); err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	return src, reset, cleanup, nil
+}
+
+// batch fans fn(0..n) out across at most c.maxConns goroutines and
+// collects the results in order
+func (c *Client) batch(ctx context.Context, n int, fn func(i int) (*Response, error)) []Result {
+	results := make([]Result, n)
+
+	c.poolMu.Lock()
+	maxConns := c.maxConns
+	c.poolMu.Unlock()
+
+	sem := make(chan struct{}, maxConns)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r, err := fn(i)
+			results[i] = Result{Response: r, Err: err}
+		}(i)
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,345 @@
+// Copyright (C) 2018 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sophie
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveFakeSavdidConn speaks just enough of the stream protocol to drive
+// a Client: it reads a "stream/N" header, replies "OK", discards N
+// bytes of body and replies "0" (clean), handling requests sequentially
+// on the connection, mirroring how a pooled connection is reused across
+// calls.
+func serveFakeSavdidConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		n, err := strconv.Atoi(strings.TrimPrefix(line, "stream/"))
+		if err != nil {
+			return
+		}
+		if _, err = conn.Write([]byte("OK\r\n")); err != nil {
+			return
+		}
+		if _, err = io.CopyN(io.Discard, r, int64(n)); err != nil {
+			return
+		}
+		if _, err = conn.Write([]byte("0\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+// startFakeSavdid starts a local TCP stub running serveFakeSavdidConn on
+// every accepted connection.
+func startFakeSavdid(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSavdidConn(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// TestPoolConcurrentResize drives ScanReaders and SetMaxConns from many
+// goroutines at once. Before the fix, a SetMaxConns racing with a
+// putConn/getConn could panic on a send to a closed channel or hand
+// back a nil *pooledConn; this must complete cleanly with no errors.
+func TestPoolConcurrentResize(t *testing.T) {
+	addr := startFakeSavdid(t)
+	c, err := NewClient("tcp", addr)
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readers := []io.Reader{strings.NewReader("hello"), strings.NewReader("world")}
+			for _, res := range c.ScanReaders(ctx, readers) {
+				if res.Err != nil {
+					t.Errorf("ScanReaders result error: %s", res.Err)
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			c.SetMaxConns(n)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// startFlakySavdid starts a local TCP stub whose first connection accepts
+// the stream header, replies "OK" and then resets the connection after
+// reading part of the body, simulating a savdid that dies mid-transfer.
+// Every later connection is served in full by serveFakeSavdidConn, so a
+// retry against a fresh connection succeeds.
+func startFlakySavdid(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		first := true
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if !first {
+				go serveFakeSavdidConn(conn)
+				continue
+			}
+			first = false
+			go func(conn net.Conn) {
+				r := bufio.NewReader(conn)
+				if _, err := r.ReadString('\n'); err != nil {
+					conn.Close()
+					return
+				}
+				if _, err := conn.Write([]byte("OK\r\n")); err != nil {
+					conn.Close()
+					return
+				}
+				io.CopyN(io.Discard, r, 1024)
+				if tc, ok := conn.(*net.TCPConn); ok {
+					tc.SetLinger(0)
+				}
+				conn.Close()
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// TestScanAllRetriesSeekBackOsFile drives ScanAll against a file-backed
+// reader whose first attempt is killed mid-transfer by the server. Before
+// the fix, withPooledConn retried fn against the same *os.File without
+// rewinding it, so the retry declared the original stat.Size() while
+// io.Copy only sent the unread remainder, hanging the retried attempt.
+func TestScanAllRetriesSeekBackOsFile(t *testing.T) {
+	addr := startFlakySavdid(t)
+	c, err := NewClient("tcp", addr)
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+	c.SetConnRetries(1)
+	c.SetConnSleep(10 * time.Millisecond)
+
+	f, err := os.CreateTemp(t.TempDir(), "sophie-scanall-*")
+	if err != nil {
+		t.Fatalf("os.CreateTemp failed: %s", err)
+	}
+	if _, err := f.Write(bytes.Repeat([]byte("a"), 64*1024)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	f.Close()
+
+	ctx := context.Background()
+	results := c.ScanAll(ctx, []string{f.Name()})
+	if len(results) != 1 {
+		t.Fatalf("len(results) = %d, want 1", len(results))
+	}
+	if results[0].Err != nil {
+		t.Errorf("ScanAll result error: %s", results[0].Err)
+	}
+}
+
+// startFlakySavdidCapturingLen behaves like startFlakySavdid, except
+// every connection after the first records the declared "stream/N"
+// length and the body it actually received on streamLens/streamBodies,
+// so a test can tell a full resend from a truncated one rather than
+// just checking for the absence of an error.
+func startFlakySavdidCapturingLen(t *testing.T) (addr string, streamLens chan int, streamBodies chan []byte) {
+	t.Helper()
+	streamLens = make(chan int, 8)
+	streamBodies = make(chan []byte, 8)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		first := true
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if first {
+				first = false
+				go func(conn net.Conn) {
+					r := bufio.NewReader(conn)
+					if _, err := r.ReadString('\n'); err != nil {
+						conn.Close()
+						return
+					}
+					if _, err := conn.Write([]byte("OK\r\n")); err != nil {
+						conn.Close()
+						return
+					}
+					io.CopyN(io.Discard, r, 10)
+					if tc, ok := conn.(*net.TCPConn); ok {
+						tc.SetLinger(0)
+					}
+					conn.Close()
+				}(conn)
+				continue
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\r\n")
+				n, err := strconv.Atoi(strings.TrimPrefix(line, "stream/"))
+				if err != nil {
+					return
+				}
+				if _, err = conn.Write([]byte("OK\r\n")); err != nil {
+					return
+				}
+				body := make([]byte, n)
+				if _, err = io.ReadFull(r, body); err != nil {
+					return
+				}
+				streamLens <- n
+				streamBodies <- body
+				conn.Write([]byte("0\r\n"))
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String(), streamLens, streamBodies
+}
+
+// TestScanReadersRetriesSeekBackSeekableReader drives ScanReaders
+// against a *strings.Reader whose first pooled attempt is killed after
+// only 10 of 1000 bytes are read. Before the fix, only *os.File readers
+// were rewound before a retry; a *strings.Reader's Len() reports just
+// the unread remainder, so the retry silently declared a short
+// "stream/N" and shipped a truncated body with no error, and the caller
+// had no way to tell the scan result apart from one that actually saw
+// the full content.
+func TestScanReadersRetriesSeekBackSeekableReader(t *testing.T) {
+	addr, streamLens, streamBodies := startFlakySavdidCapturingLen(t)
+	c, err := NewClient("tcp", addr)
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+	c.SetConnRetries(1)
+	c.SetConnSleep(10 * time.Millisecond)
+
+	want := bytes.Repeat([]byte("b"), 1000)
+	ctx := context.Background()
+	results := c.ScanReaders(ctx, []io.Reader{strings.NewReader(string(want))})
+	if len(results) != 1 {
+		t.Fatalf("len(results) = %d, want 1", len(results))
+	}
+	if results[0].Err != nil {
+		t.Fatalf("ScanReaders result error: %s", results[0].Err)
+	}
+
+	select {
+	case n := <-streamLens:
+		if n != len(want) {
+			t.Errorf("retried stream declared length = %d, want %d", n, len(want))
+		}
+	default:
+		t.Fatal("retried connection never received a stream request")
+	}
+
+	body := <-streamBodies
+	if !bytes.Equal(body, want) {
+		t.Errorf("retried stream body = %q, want %q", body, want)
+	}
+}
+
+// TestScanReadersRetriesResendsSpooledBuffer is
+// TestScanReadersRetriesSeekBackSeekableReader's counterpart for
+// *bytes.Buffer, which streamPath sizes via Len() like the seekable
+// readers but, unlike them, cannot be rewound at all: it must be
+// spooled once by resettableReader so each attempt reads an independent
+// copy.
+func TestScanReadersRetriesResendsSpooledBuffer(t *testing.T) {
+	addr, streamLens, streamBodies := startFlakySavdidCapturingLen(t)
+	c, err := NewClient("tcp", addr)
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+	c.SetConnRetries(1)
+	c.SetConnSleep(10 * time.Millisecond)
+
+	want := bytes.Repeat([]byte("c"), 1000)
+	ctx := context.Background()
+	results := c.ScanReaders(ctx, []io.Reader{bytes.NewBuffer(want)})
+	if len(results) != 1 {
+		t.Fatalf("len(results) = %d, want 1", len(results))
+	}
+	if results[0].Err != nil {
+		t.Fatalf("ScanReaders result error: %s", results[0].Err)
+	}
+
+	select {
+	case n := <-streamLens:
+		if n != len(want) {
+			t.Errorf("retried stream declared length = %d, want %d", n, len(want))
+		}
+	default:
+		t.Fatal("retried connection never received a stream request")
+	}
+
+	body := <-streamBodies
+	if !bytes.Equal(body, want) {
+		t.Errorf("retried stream body = %q, want %q", body, want)
+	}
+}
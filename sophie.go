@@ -11,26 +11,24 @@ package sophie
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	defaultSleep        = 1 * time.Second
-	defaultTimeout      = 15 * time.Second
-	defaultCmdTimeout   = 1 * time.Minute
-	defaultSock         = "/var/lib/savdid/savdid.sock"
-	invalidRespErr      = "Invalid server response: %s"
-	unsupportedProtoErr = "Protocol: %s is not supported"
-	unixSockErr         = "The unix socket: %s does not exist"
-	unknownStatusErr    = "Unknown status"
-	noSizeErr           = "The content length could not be determined"
-	tcpDirErr           = "Scanning directories not supported on a TCP connection"
+	defaultSleep      = 1 * time.Second
+	defaultTimeout    = 15 * time.Second
+	defaultCmdTimeout = 1 * time.Minute
+	defaultSock       = "/var/lib/savdid/savdid.sock"
+	defaultMaxConns   = 1
 )
 
 // Response is the response from the server
@@ -43,12 +41,18 @@ type Response struct {
 
 // A Client represents a Sophie client.
 type Client struct {
-	network     string
-	address     string
-	connTimeout time.Duration
-	connRetries int
-	connSleep   time.Duration
-	cmdTimeout  time.Duration
+	network      string
+	address      string
+	connTimeout  time.Duration
+	connRetries  int
+	connSleep    time.Duration
+	cmdTimeout   time.Duration
+	maxConns     int
+	pool         chan *pooledConn
+	poolMu       sync.Mutex
+	spoolDir     string
+	maxSpoolSize int64
+	tlsConfig    *tls.Config
 }
 
 // SetConnTimeout sets the connection timeout
@@ -78,7 +82,14 @@ func (c *Client) SetConnSleep(s time.Duration) {
 
 // Scan a file or directory
 func (c *Client) Scan(p string) (r *Response, err error) {
-	r, err = c.fileCmd(p)
+	r, err = c.fileCmd(context.Background(), p)
+	return
+}
+
+// ScanContext scans a file or directory, aborting the scan if ctx
+// is cancelled or its deadline is exceeded
+func (c *Client) ScanContext(ctx context.Context, p string) (r *Response, err error) {
+	r, err = c.fileCmd(ctx, p)
 	return
 }
 
@@ -90,30 +101,84 @@ func (c *Client) Scan(p string) (r *Response, err error) {
 
 // ScanReader scans an io.reader
 func (c *Client) ScanReader(i io.Reader) (r *Response, err error) {
-	r, err = c.readerCmd(i)
+	r, err = c.readerCmd(context.Background(), i)
 	return
 }
 
-func (c *Client) dial() (conn net.Conn, err error) {
-	d := &net.Dialer{}
+// ScanReaderContext scans an io.Reader, aborting the scan if ctx
+// is cancelled or its deadline is exceeded
+func (c *Client) ScanReaderContext(ctx context.Context, i io.Reader) (r *Response, err error) {
+	r, err = c.readerCmd(ctx, i)
+	return
+}
 
+// deadline returns ctx's deadline if it has one, time.Now() if ctx is
+// already done, otherwise a deadline d from now, for use with
+// net.Conn.SetDeadline
+func deadline(ctx context.Context, d time.Duration) time.Time {
+	select {
+	case <-ctx.Done():
+		return time.Now()
+	default:
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		return dl
+	}
+	return time.Now().Add(d)
+}
+
+// watchCancel arranges for conn's deadline to be forced to time.Now()
+// if ctx is done before the returned stop func is called, so that a
+// Read/Write already blocked on conn when a deadline-less ctx (e.g. one
+// from context.WithCancel) is cancelled returns promptly instead of
+// riding out cmdTimeout. The caller must call stop once it is done
+// using conn.
+func watchCancel(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (c *Client) dial(ctx context.Context) (conn net.Conn, err error) {
+	nd := &net.Dialer{}
 	if c.connTimeout > 0 {
-		d.Timeout = c.connTimeout
+		nd.Timeout = c.connTimeout
+	}
+
+	dialContext := nd.DialContext
+	if c.tlsConfig != nil {
+		dialContext = (&tls.Dialer{NetDialer: nd, Config: c.tlsConfig}).DialContext
 	}
 
 	for i := 0; i <= c.connRetries; i++ {
-		conn, err = d.Dial(c.network, c.address)
+		conn, err = dialContext(ctx, c.network, c.address)
 		if e, ok := err.(net.Error); ok && e.Timeout() {
-			time.Sleep(c.connSleep)
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			case <-time.After(c.connSleep):
+			}
 			continue
 		}
 		break
 	}
+	if err != nil {
+		err = &SophieError{Op: "dial", Net: c.network, Err: err}
+	}
 	return
 }
 
-func (c *Client) fileCmd(p string) (r *Response, err error) {
-	var id uint
+func (c *Client) fileCmd(ctx context.Context, p string) (r *Response, err error) {
 	var isTCP bool
 	var f *os.File
 	var conn net.Conn
@@ -127,7 +192,7 @@ func (c *Client) fileCmd(p string) (r *Response, err error) {
 	if c.network != "unix" && c.network != "unixpacket" {
 		isTCP = true
 		if stat.IsDir() {
-			err = fmt.Errorf(tcpDirErr)
+			err = &SophieError{Op: "scan", Net: c.network, Path: p, Err: ErrTCPDir}
 			return
 		}
 	}
@@ -138,9 +203,9 @@ func (c *Client) fileCmd(p string) (r *Response, err error) {
 		}
 		defer f.Close()
 
-		r, err = c.readerCmd(f)
+		r, err = c.readerCmd(ctx, f)
 	} else {
-		conn, err = c.dial()
+		conn, err = c.dial(ctx)
 		if err != nil {
 			return
 		}
@@ -148,35 +213,40 @@ func (c *Client) fileCmd(p string) (r *Response, err error) {
 		tc = textproto.NewConn(conn)
 		defer tc.Close()
 
-		id = tc.Next()
-		tc.StartRequest(id)
+		r, err = c.scanPath(ctx, conn, tc, p)
+	}
 
-		conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		if err = tc.PrintfLine("%s", p); err != nil {
-			tc.EndRequest(id)
-			return
-		}
+	return
+}
 
-		tc.EndRequest(id)
-		tc.StartResponse(id)
-		defer tc.EndResponse(id)
+// scanPath runs the path-based scan command over an already established
+// connection, used both for one-shot unix scans and pooled scans
+func (c *Client) scanPath(ctx context.Context, conn net.Conn, tc *textproto.Conn, p string) (r *Response, err error) {
+	stop := watchCancel(ctx, conn)
+	defer stop()
 
-		conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-		r, err = c.processResponse(tc, p)
+	id := tc.Next()
+	tc.StartRequest(id)
+
+	conn.SetDeadline(deadline(ctx, c.cmdTimeout))
+	if err = tc.PrintfLine("%s", p); err != nil {
+		tc.EndRequest(id)
+		return
 	}
 
+	tc.EndRequest(id)
+	tc.StartResponse(id)
+	defer tc.EndResponse(id)
+
+	r, err = c.processResponse(ctx, conn, tc, "scan", p)
 	return
 }
 
-func (c *Client) readerCmd(i io.Reader) (r *Response, err error) {
-	var id uint
-	var l string
-	var clen int64
+func (c *Client) readerCmd(ctx context.Context, i io.Reader) (r *Response, err error) {
 	var conn net.Conn
-	var stat os.FileInfo
 	var tc *textproto.Conn
 
-	conn, err = c.dial()
+	conn, err = c.dial(ctx)
 	if err != nil {
 		return
 	}
@@ -184,6 +254,21 @@ func (c *Client) readerCmd(i io.Reader) (r *Response, err error) {
 	tc = textproto.NewConn(conn)
 	defer tc.Close()
 
+	r, err = c.streamPath(ctx, conn, tc, i)
+	return
+}
+
+// streamPath runs the stream-based scan command over an already established
+// connection, used both for one-shot reader scans and pooled scans
+func (c *Client) streamPath(ctx context.Context, conn net.Conn, tc *textproto.Conn, i io.Reader) (r *Response, err error) {
+	stop := watchCancel(ctx, conn)
+	defer stop()
+
+	var id uint
+	var l string
+	var clen int64
+	var stat os.FileInfo
+
 	switch v := i.(type) {
 	case *bytes.Buffer:
 		clen = int64(v.Len())
@@ -198,32 +283,37 @@ func (c *Client) readerCmd(i io.Reader) (r *Response, err error) {
 		}
 		clen = stat.Size()
 	default:
-		err = fmt.Errorf(noSizeErr)
-		return
+		var cleanup func()
+		if i, clen, cleanup, err = c.sizeReader(ctx, i); err != nil {
+			cleanup()
+			err = &SophieError{Op: "stream", Net: c.network, Err: err}
+			return
+		}
+		defer cleanup()
 	}
 
 	id = tc.Next()
 	tc.StartRequest(id)
 
-	conn.SetDeadline(time.Now().Add(c.cmdTimeout))
+	conn.SetDeadline(deadline(ctx, c.cmdTimeout))
 	if err = tc.PrintfLine("stream/%d", clen); err != nil {
 		tc.EndRequest(id)
 		return
 	}
 
-	conn.SetDeadline(time.Now().Add(c.cmdTimeout))
+	conn.SetDeadline(deadline(ctx, c.cmdTimeout))
 	if l, err = tc.ReadLine(); err != nil {
 		tc.EndRequest(id)
 		return
 	}
 
 	if l != "OK" {
-		err = fmt.Errorf(invalidRespErr, l)
+		err = &SophieError{Op: "stream", Net: c.network, Addr: conn.RemoteAddr(), Err: fmt.Errorf("%w: %s", ErrInvalidResponse, l)}
 		tc.EndRequest(id)
 		return
 	}
 
-	conn.SetDeadline(time.Now().Add(c.cmdTimeout))
+	conn.SetDeadline(deadline(ctx, c.cmdTimeout))
 	if _, err = io.Copy(tc.Writer.W, i); err != nil {
 		tc.EndRequest(id)
 		return
@@ -234,15 +324,15 @@ func (c *Client) readerCmd(i io.Reader) (r *Response, err error) {
 	tc.StartResponse(id)
 	defer tc.EndResponse(id)
 
-	conn.SetDeadline(time.Now().Add(c.cmdTimeout))
-	r, err = c.processResponse(tc, "")
+	r, err = c.processResponse(ctx, conn, tc, "stream", "")
 
 	return
 }
 
-func (c *Client) processResponse(tc *textproto.Conn, p string) (r *Response, err error) {
+func (c *Client) processResponse(ctx context.Context, conn net.Conn, tc *textproto.Conn, op, p string) (r *Response, err error) {
 	var l string
 
+	conn.SetDeadline(deadline(ctx, c.cmdTimeout))
 	if l, err = tc.ReadLine(); err != nil {
 		return
 	}
@@ -255,7 +345,7 @@ func (c *Client) processResponse(tc *textproto.Conn, p string) (r *Response, err
 	}
 
 	if strings.HasPrefix(l, "-1") {
-		err = fmt.Errorf(unknownStatusErr)
+		err = &SophieError{Op: op, Net: c.network, Addr: conn.RemoteAddr(), Path: p, Err: ErrUnknownStatus}
 	} else if strings.HasPrefix(l, "1") || strings.HasPrefix(l, "0") {
 		r.Raw = l
 		if strings.HasPrefix(l, "1") {
@@ -263,7 +353,7 @@ func (c *Client) processResponse(tc *textproto.Conn, p string) (r *Response, err
 			r.Infected = true
 		}
 	} else {
-		err = fmt.Errorf(invalidRespErr, l)
+		err = &SophieError{Op: op, Net: c.network, Addr: conn.RemoteAddr(), Path: p, Err: fmt.Errorf("%w: %s", ErrInvalidResponse, l)}
 	}
 
 	return
@@ -277,23 +367,26 @@ func NewClient(network, address string) (c *Client, err error) {
 	}
 
 	if network != "unix" && network != "unixpacket" && network != "tcp" && network != "tcp4" && network != "tcp6" {
-		err = fmt.Errorf(unsupportedProtoErr, network)
+		err = &SophieError{Op: "dial", Net: network, Err: ErrUnsupportedProto}
 		return
 	}
 
 	if network == "unix" || network == "unixpacket" {
 		if _, err = os.Stat(address); os.IsNotExist(err) {
-			err = fmt.Errorf(unixSockErr, address)
+			err = &SophieError{Op: "dial", Net: network, Path: address, Err: ErrUnixSockMissing}
 			return
 		}
 	}
 
 	c = &Client{
-		network:     network,
-		address:     address,
-		connTimeout: defaultTimeout,
-		connSleep:   defaultSleep,
-		cmdTimeout:  defaultCmdTimeout,
+		network:      network,
+		address:      address,
+		connTimeout:  defaultTimeout,
+		connSleep:    defaultSleep,
+		cmdTimeout:   defaultCmdTimeout,
+		maxConns:     defaultMaxConns,
+		pool:         make(chan *pooledConn, defaultMaxConns),
+		maxSpoolSize: defaultMaxSpoolSize,
 	}
 	return
 }
@@ -12,7 +12,7 @@ package sophie
 import (
 	"bytes"
 	"compress/bzip2"
-	"fmt"
+	"errors"
 	"net"
 	"os"
 	"strings"
@@ -26,34 +26,37 @@ const (
 )
 
 func TestBasics(t *testing.T) {
-	var expected string
 	// Test Non existent socket
 	sockname := "/tmp/.dumx.sock"
 	_, e := NewClient("unix", sockname)
 	if e == nil {
 		t.Fatalf("An error should be returned as sock does not exist")
 	}
-	expected = fmt.Sprintf(unixSockErr, sockname)
-	if e.Error() != expected {
-		t.Errorf("Expected %q want %q", expected, e)
+	if !errors.Is(e, ErrUnixSockMissing) {
+		t.Errorf("Got %q want an error wrapping %q", e, ErrUnixSockMissing)
+	}
+	var se *SophieError
+	if !errors.As(e, &se) || se.Path != sockname {
+		t.Errorf("Got %q want a *SophieError with Path %q", e, sockname)
 	}
 	// Test defaults
 	_, e = NewClient("", "")
 	if e == nil {
 		t.Fatalf("An error should be returned as sock does not exist")
 	}
-	expected = fmt.Sprintf(unixSockErr, defaultSock)
-	if e.Error() != expected {
-		t.Errorf("Got %q want %q", expected, e)
+	if !errors.Is(e, ErrUnixSockMissing) {
+		t.Errorf("Got %q want an error wrapping %q", e, ErrUnixSockMissing)
+	}
+	if !errors.As(e, &se) || se.Path != defaultSock {
+		t.Errorf("Got %q want a *SophieError with Path %q", e, defaultSock)
 	}
 	// Test udp
 	_, e = NewClient("udp", "127.1.1.1:4010")
 	if e == nil {
 		t.Fatalf("Expected an error got nil")
 	}
-	expected = "Protocol: udp is not supported"
-	if e.Error() != expected {
-		t.Errorf("Got %q want %q", expected, e)
+	if !errors.Is(e, ErrUnsupportedProto) {
+		t.Errorf("Got %q want an error wrapping %q", e, ErrUnsupportedProto)
 	}
 	// Test tcp
 	network := "tcp"
@@ -108,6 +111,20 @@ func TestSettings(t *testing.T) {
 	if c.connRetries != 0 {
 		t.Errorf("Preventing negative values in c.SetConnRetries(%q) failed", -2)
 	}
+	if c.maxConns != defaultMaxConns {
+		t.Errorf("The default max conns should be set")
+	}
+	c.SetMaxConns(5)
+	if c.maxConns != 5 {
+		t.Errorf("Calling c.SetMaxConns(%d) failed", 5)
+	}
+	if cap(c.pool) != 5 {
+		t.Errorf("Calling c.SetMaxConns(%d) did not resize the pool", 5)
+	}
+	c.SetMaxConns(0)
+	if c.maxConns != 1 {
+		t.Errorf("Preventing values below 1 in c.SetMaxConns(%d) failed", 0)
+	}
 }
 
 func TestMethodsErrors(t *testing.T) {
@@ -123,10 +140,10 @@ func TestMethodsErrors(t *testing.T) {
 	if _, e = c.Scan(fn); e == nil {
 		t.Fatalf("An error should be returned")
 	}
-	if _, ok := e.(*net.OpError); !ok {
-		t.Errorf("Expected *net.OpError want %q", e)
+	var opErr *net.OpError
+	if !errors.As(e, &opErr) {
+		t.Errorf("Expected an error wrapping *net.OpError want %q", e)
 	}
-
 }
 
 func TestUnixScan(t *testing.T) {
@@ -212,8 +229,8 @@ func TestTCPScan(t *testing.T) {
 		if e == nil {
 			t.Fatal("An error should be returned")
 		}
-		if e.Error() != tcpDirErr {
-			t.Errorf("c.Scan(%q) returned error '%s' want '%s'", fn, e, tcpDirErr)
+		if !errors.Is(e, ErrTCPDir) {
+			t.Errorf("c.Scan(%q) returned error %q want an error wrapping %q", fn, e, ErrTCPDir)
 		}
 		fn = "./examples/data/noexist.txt"
 		s, e = c.Scan(fn)
@@ -228,9 +245,10 @@ func TestTCPScan(t *testing.T) {
 	}
 }
 
-func TestTCPScanStreamError(t *testing.T) {
+func TestTCPScanUnsizedStream(t *testing.T) {
 	var e error
 	var c *Client
+	var s *Response
 
 	skip := false
 	address := os.Getenv("SOPHIE_TCP_ADDRESS")
@@ -259,12 +277,18 @@ func TestTCPScanStreamError(t *testing.T) {
 		}
 		defer f.Close()
 		ir := bzip2.NewReader(f)
-		_, e = c.ScanReader(ir)
-		if e == nil {
-			t.Fatal("An error should be returned")
+		s, e = c.ScanReader(ir)
+		if e != nil {
+			t.Fatalf("An error should not be returned: %s", e)
+		}
+		if s.Filename != "stream" {
+			t.Errorf("c.ScanReader(%q) = %q, want %q", fn, s.Filename, "stream")
+		}
+		if !s.Infected {
+			t.Errorf("c.ScanReader(%q).Infected = %t, want %t", fn, s.Infected, true)
 		}
-		if e.Error() != noSizeErr {
-			t.Errorf("Got %s want %s", e, noSizeErr)
+		if s.Signature != "EICAR-AV-Test" {
+			t.Errorf("c.ScanReader(%q).Signature = %s, want %s", fn, s.Signature, "EICAR-AV-Test")
 		}
 	} else {
 		t.Skip("skipping test; $SOPHIE_TCP_ADDRESS not set")
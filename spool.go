@@ -0,0 +1,140 @@
+// Copyright (C) 2018 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sophie
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+)
+
+// defaultMaxSpoolSize is the number of bytes buffered in memory, for a
+// reader whose length cannot be determined upfront, before spilling to
+// a temp file
+const defaultMaxSpoolSize int64 = 1 << 20 // 1MiB
+
+// spoolChunkSize bounds how much is read from the caller-supplied
+// reader between ctx.Done() checks in copyContext/copyNContext
+const spoolChunkSize = 32 * 1024
+
+// SetSpoolDir sets the directory used to spool, to a temp file, readers
+// whose length cannot be determined upfront and that exceed
+// MaxSpoolSize. An empty path (the default) uses os.TempDir.
+func (c *Client) SetSpoolDir(path string) {
+	c.spoolDir = path
+}
+
+// SetMaxSpoolSize sets the number of bytes of a length-unknown reader
+// that are buffered in memory before spilling the rest to a temp file
+// under SpoolDir
+func (c *Client) SetMaxSpoolSize(n int64) {
+	if n < 0 {
+		n = 0
+	}
+	c.maxSpoolSize = n
+}
+
+// sizeReader returns a reader equivalent to i along with its length and
+// a cleanup func that must be called once the caller is done with the
+// reader, for readers whose length cannot be determined upfront (i.e.
+// not one of the types streamPath already knows how to size).
+//
+// Up to MaxSpoolSize bytes are buffered in memory; if i is not
+// exhausted within them (it holds MaxSpoolSize bytes or more), the
+// buffered prefix and the remainder of i are spilled to a temp file
+// under SpoolDir, which is removed by cleanup. Reads from i are done in
+// chunks of up to spoolChunkSize bytes with ctx checked between chunks;
+// a chunk is read until it is full or i ends, and a Read that blocks is
+// not interrupted by ctx.
+func (c *Client) sizeReader(ctx context.Context, i io.Reader) (src io.Reader, clen int64, cleanup func(), err error) {
+	cleanup = func() {}
+
+	buf := &bytes.Buffer{}
+	n, err := copyNContext(ctx, buf, i, c.maxSpoolSize)
+	if err != nil && err != io.EOF {
+		return nil, 0, cleanup, err
+	}
+	if err == io.EOF {
+		// i fit entirely within MaxSpoolSize
+		return bytes.NewReader(buf.Bytes()), n, cleanup, nil
+	}
+
+	f, err := os.CreateTemp(c.spoolDir, "sophie-spool-*")
+	if err != nil {
+		return nil, 0, cleanup, err
+	}
+	cleanup = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		return nil, 0, cleanup, err
+	}
+	if _, err = copyContext(ctx, f, i); err != nil {
+		return nil, 0, cleanup, err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, cleanup, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, 0, cleanup, err
+	}
+
+	return f, stat.Size(), cleanup, nil
+}
+
+// copyNContext is io.CopyN bounded by ctx: it copies in spoolChunkSize
+// chunks and checks ctx.Done() between them, returning ctx.Err() if the
+// context is cancelled before n bytes are copied.
+func copyNContext(ctx context.Context, dst io.Writer, src io.Reader, n int64) (written int64, err error) {
+	for written < n {
+		select {
+		case <-ctx.Done():
+			return written, ctx.Err()
+		default:
+		}
+		chunk := int64(spoolChunkSize)
+		if remaining := n - written; remaining < chunk {
+			chunk = remaining
+		}
+		var w int64
+		w, err = io.CopyN(dst, src, chunk)
+		written += w
+		if err != nil {
+			if err == io.EOF {
+				return written, io.EOF
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// copyContext is io.Copy bounded by ctx: it copies in spoolChunkSize
+// chunks and checks ctx.Done() between them, returning ctx.Err() if the
+// context is cancelled before src is exhausted.
+func copyContext(ctx context.Context, dst io.Writer, src io.Reader) (written int64, err error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return written, ctx.Err()
+		default:
+		}
+		var w int64
+		w, err = io.CopyN(dst, src, spoolChunkSize)
+		written += w
+		if err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2018 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sophie
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// infiniteReader never returns an error or EOF, simulating an endless
+// network/compressed reader
+type infiniteReader struct{}
+
+func (infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestSizeReaderBuffersSmallReader(t *testing.T) {
+	c, err := NewClient("tcp", "127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+
+	content := "hello sophie"
+	src, clen, cleanup, err := c.sizeReader(context.Background(), strings.NewReader(content))
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("sizeReader failed: %s", err)
+	}
+	if clen != int64(len(content)) {
+		t.Errorf("sizeReader clen = %d, want %d", clen, len(content))
+	}
+	if _, ok := src.(*os.File); ok {
+		t.Errorf("sizeReader spilled a small reader to disk, want in-memory")
+	}
+	got, err := io.ReadAll(src)
+	if err != nil {
+		t.Fatalf("reading src failed: %s", err)
+	}
+	if string(got) != content {
+		t.Errorf("sizeReader content = %q, want %q", got, content)
+	}
+}
+
+func TestSizeReaderSpoolsLargeReader(t *testing.T) {
+	c, err := NewClient("tcp", "127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+	c.SetMaxSpoolSize(4)
+
+	content := "hello sophie, this is longer than the spool size"
+	src, clen, cleanup, err := c.sizeReader(context.Background(), strings.NewReader(content))
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("sizeReader failed: %s", err)
+	}
+	if clen != int64(len(content)) {
+		t.Errorf("sizeReader clen = %d, want %d", clen, len(content))
+	}
+	f, ok := src.(*os.File)
+	if !ok {
+		t.Fatalf("sizeReader kept a large reader in memory, want a spooled temp file")
+	}
+	if _, err = os.Stat(f.Name()); err != nil {
+		t.Errorf("spooled temp file missing: %s", err)
+	}
+	got, err := io.ReadAll(src)
+	if err != nil {
+		t.Fatalf("reading src failed: %s", err)
+	}
+	if string(got) != content {
+		t.Errorf("sizeReader content = %q, want %q", got, content)
+	}
+	cleanup()
+	if _, err = os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("cleanup did not remove spooled temp file")
+	}
+}
+
+// TestSizeReaderRespectsContextCancellation guards against sizeReader
+// running forever on an endless reader: before ctx was threaded
+// through, this spooled an infinite reader to disk with no way to stop.
+func TestSizeReaderRespectsContextCancellation(t *testing.T) {
+	c, err := NewClient("tcp", "127.0.0.1:1")
+	if err != nil {
+		t.Fatalf("NewClient failed: %s", err)
+	}
+	c.SetMaxSpoolSize(1024)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, cleanup, err := c.sizeReader(ctx, infiniteReader{})
+		cleanup()
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("sizeReader did not respect context cancellation")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("sizeReader error = %v, want context.DeadlineExceeded", err)
+	}
+}
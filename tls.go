@@ -0,0 +1,33 @@
+// Copyright (C) 2018 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sophie
+
+import "crypto/tls"
+
+// NewTLSClient returns a new Sophie client that speaks TLS to a remote
+// savdid, for deployments fronted by stunnel or a service mesh. network
+// must be one of tcp, tcp4 or tcp6. cfg is used as-is for the handshake,
+// so SNI and mutual TLS are configured through it.
+func NewTLSClient(network, address string, cfg *tls.Config) (c *Client, err error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		err = &SophieError{Op: "dial", Net: network, Err: ErrUnsupportedProto}
+		return
+	}
+
+	if c, err = NewClient(network, address); err != nil {
+		return
+	}
+	c.SetTLSConfig(cfg)
+	return
+}
+
+// SetTLSConfig sets the tls.Config used to secure the connection. Passing
+// a non-nil cfg makes dial wrap the connection with tls.Client, retrying
+// the handshake under the same ConnTimeout/ConnRetries/ConnSleep policy
+// used for plain dials. Passing nil reverts to a plain connection.
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.tlsConfig = cfg
+}
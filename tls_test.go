@@ -0,0 +1,132 @@
+// Copyright (C) 2018 Andrew Colin Kissa <andrew@datopdog.io>
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sophie
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// generateTestCert returns a self-signed certificate valid for 127.0.0.1,
+// for use by a local TLS test server.
+func generateTestCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey failed: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"sophie-test"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate failed: %s", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey failed: %s", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("tls.X509KeyPair failed: %s", err)
+	}
+	return cert
+}
+
+// startFakeTLSSavdid starts a local TLS stub running serveFakeSavdidConn
+// over a TLS listener secured with a freshly generated self-signed cert.
+func startFakeTLSSavdid(t *testing.T) string {
+	t.Helper()
+	cert := generateTestCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("tls.Listen failed: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSavdidConn(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestNewTLSClientRejectsUnixNetworks(t *testing.T) {
+	for _, network := range []string{"unix", "unixpacket"} {
+		_, err := NewTLSClient(network, "/tmp/sophie.sock", &tls.Config{})
+		if err == nil {
+			t.Fatalf("NewTLSClient(%q, ...) should return an error", network)
+		}
+		if !errors.Is(err, ErrUnsupportedProto) {
+			t.Errorf("NewTLSClient(%q, ...) error = %q, want an error wrapping %q", network, err, ErrUnsupportedProto)
+		}
+	}
+}
+
+func TestTLSScanReader(t *testing.T) {
+	addr := startFakeTLSSavdid(t)
+	c, err := NewTLSClient("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("NewTLSClient failed: %s", err)
+	}
+
+	s, err := c.ScanReader(strings.NewReader("hello sophie"))
+	if err != nil {
+		t.Fatalf("ScanReader failed: %s", err)
+	}
+	if s.Infected {
+		t.Errorf("ScanReader().Infected = %t, want %t", s.Infected, false)
+	}
+}
+
+func TestTLSScanReaderHandshakeFailure(t *testing.T) {
+	addr := startFakeTLSSavdid(t)
+	// no InsecureSkipVerify and no trusted CA: the handshake against our
+	// self-signed cert must fail rather than silently falling back to a
+	// plaintext connection.
+	c, err := NewTLSClient("tcp", addr, &tls.Config{})
+	if err != nil {
+		t.Fatalf("NewTLSClient failed: %s", err)
+	}
+	c.SetConnRetries(0)
+
+	_, err = c.ScanReader(strings.NewReader("hello sophie"))
+	if err == nil {
+		t.Fatal("ScanReader should fail when the server cert isn't trusted")
+	}
+}